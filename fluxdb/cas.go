@@ -0,0 +1,119 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/eoscanada/eos-go"
+)
+
+// RowCID is the content address of a TableDataRow's payload: the hex-encoded
+// sha256 of the raw bytes. Two rows with identical bytes - whether
+// rewritten to the same value, or duplicated across competing forks -
+// collapse to the same CID and are stored once.
+type RowCID string
+
+// ComputeRowCID is called by IndexRowsWithCIDs once per non-deleted row.
+// PreprocessBlock does not compute CIDs, and TableDataRow carries no CID.
+func ComputeRowCID(data []byte) RowCID {
+	sum := sha256.Sum256(data)
+	return RowCID(hex.EncodeToString(sum[:]))
+}
+
+// TableDataIndexEntry is what the per-(block, code, scope, table, key)
+// index stores once row payloads move out to a content-addressed blob
+// store: just enough to resolve an index key to a blob, without the
+// payload bytes themselves.
+type TableDataIndexEntry struct {
+	Code, Scope, Table, Key, Payer eos.Name
+	Deletion                       bool
+	CID                            RowCID
+}
+
+// BlobStore is the content-addressed payload store backing TableDataRow
+// data. It only knows bytes in, bytes out; it has no notion of blocks,
+// forks, or LIB.
+type BlobStore interface {
+	Put(cid RowCID, data []byte) error
+	Get(cid RowCID) (data []byte, found bool, err error)
+}
+
+// IndexRowsWithCIDs computes the CID of every row's payload, stores it in
+// store, and returns the CID-only index entries that replace the payload
+// in the per-key index. Deleted rows carry no payload and no CID.
+func IndexRowsWithCIDs(store BlobStore, rows []*TableDataRow) ([]*TableDataIndexEntry, error) {
+	entries := make([]*TableDataIndexEntry, len(rows))
+
+	for i, row := range rows {
+		entry := &TableDataIndexEntry{
+			Code: row.Code, Scope: row.Scope, Table: row.Table, Key: row.Key,
+			Payer: row.Payer, Deletion: row.Deletion,
+		}
+
+		if !row.Deletion {
+			cid := ComputeRowCID(row.Data)
+			if err := store.Put(cid, row.Data); err != nil {
+				return nil, fmt.Errorf("storing row payload for %s/%s/%s/%s: %w",
+					eos.NameToString(row.Code), eos.NameToString(row.Scope), eos.NameToString(row.Table), eos.NameToString(row.Key), err)
+			}
+			entry.CID = cid
+		}
+
+		entries[i] = entry
+	}
+
+	return entries, nil
+}
+
+// GetRowByCID fetches a raw row payload directly from the blob store, for
+// external indexers that know a CID (e.g. from a TableDataIndexEntry) but
+// not its (scope, key) location.
+func GetRowByCID(store BlobStore, cid RowCID) ([]byte, bool, error) {
+	return store.Get(cid)
+}
+
+// SweepableBlobStore is a BlobStore that can also enumerate and delete its
+// contents, which is all GCUnreferencedCIDs needs to reclaim space.
+type SweepableBlobStore interface {
+	BlobStore
+	ListCIDs() ([]RowCID, error)
+	Delete(cid RowCID) error
+}
+
+// GCUnreferencedCIDs sweeps store for CIDs that aren't referenced by any
+// index entry still reachable from a live or within-LIB block. live is
+// that reachable set, typically built by the caller from the index rather
+// than from the blob store itself.
+func GCUnreferencedCIDs(store SweepableBlobStore, live map[RowCID]bool) (swept int, err error) {
+	all, err := store.ListCIDs()
+	if err != nil {
+		return 0, fmt.Errorf("listing CIDs: %w", err)
+	}
+
+	for _, cid := range all {
+		if live[cid] {
+			continue
+		}
+		if err := store.Delete(cid); err != nil {
+			return swept, fmt.Errorf("deleting unreferenced CID %s: %w", cid, err)
+		}
+		swept++
+	}
+
+	return swept, nil
+}
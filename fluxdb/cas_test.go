@@ -0,0 +1,99 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type memBlobStore struct {
+	blobs map[RowCID][]byte
+}
+
+func newMemBlobStore() *memBlobStore {
+	return &memBlobStore{blobs: map[RowCID][]byte{}}
+}
+
+func (s *memBlobStore) Put(cid RowCID, data []byte) error {
+	s.blobs[cid] = data
+	return nil
+}
+
+func (s *memBlobStore) Get(cid RowCID) ([]byte, bool, error) {
+	data, found := s.blobs[cid]
+	return data, found, nil
+}
+
+func (s *memBlobStore) ListCIDs() ([]RowCID, error) {
+	cids := make([]RowCID, 0, len(s.blobs))
+	for cid := range s.blobs {
+		cids = append(cids, cid)
+	}
+	return cids, nil
+}
+
+func (s *memBlobStore) Delete(cid RowCID) error {
+	delete(s.blobs, cid)
+	return nil
+}
+
+func TestComputeRowCID_SameBytesSameCID(t *testing.T) {
+	assert.Equal(t, ComputeRowCID([]byte("hello")), ComputeRowCID([]byte("hello")))
+	assert.NotEqual(t, ComputeRowCID([]byte("hello")), ComputeRowCID([]byte("world")))
+}
+
+func TestIndexRowsWithCIDs_DedupesIdenticalPayloads(t *testing.T) {
+	store := newMemBlobStore()
+	rows := []*TableDataRow{
+		{N("eosio.token"), N("alice"), N("accounts"), N("EOS"), N("alice"), false, []byte("same bytes")},
+		{N("eosio.token"), N("bob"), N("accounts"), N("EOS"), N("bob"), false, []byte("same bytes")},
+		{N("eosio.token"), N("alice"), N("accounts"), N("USD"), N("alice"), true, nil},
+	}
+
+	entries, err := IndexRowsWithCIDs(store, rows)
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+
+	assert.Equal(t, entries[0].CID, entries[1].CID)
+	assert.NotEmpty(t, entries[0].CID)
+	assert.Empty(t, entries[2].CID, "deleted rows carry no payload or CID")
+	assert.Len(t, store.blobs, 1, "identical payloads are stored once")
+
+	data, found, err := GetRowByCID(store, entries[0].CID)
+	require.NoError(t, err)
+	assert.True(t, found)
+	assert.Equal(t, []byte("same bytes"), data)
+}
+
+func TestGCUnreferencedCIDs_SweepsOnlyDeadCIDs(t *testing.T) {
+	store := newMemBlobStore()
+	require.NoError(t, store.Put(RowCID("live"), []byte("d1")))
+	require.NoError(t, store.Put(RowCID("dead"), []byte("d2")))
+
+	swept, err := GCUnreferencedCIDs(store, map[RowCID]bool{RowCID("live"): true})
+	require.NoError(t, err)
+	assert.Equal(t, 1, swept)
+
+	_, found, err := store.Get(RowCID("dead"))
+	require.NoError(t, err)
+	assert.False(t, found)
+
+	_, found, err = store.Get(RowCID("live"))
+	require.NoError(t, err)
+	assert.True(t, found)
+}
@@ -0,0 +1,237 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/dfuse-io/dfuse-eosio/codec"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"github.com/eoscanada/eos-go"
+)
+
+// DiffFilter narrows a diff subscription down to a subset of rows. A zero
+// value for a field matches any value of that field; an empty DiffFilter
+// matches every row.
+type DiffFilter struct {
+	Account    eos.Name
+	Table      eos.Name
+	Scope      eos.Name
+	PrimaryKey eos.Name
+}
+
+func (f DiffFilter) isEmpty() bool {
+	return f.Account == 0 && f.Table == 0 && f.Scope == 0 && f.PrimaryKey == 0
+}
+
+func (f DiffFilter) matchesTableData(row *TableDataRow) bool {
+	return (f.Account == 0 || f.Account == row.Code) &&
+		(f.Table == 0 || f.Table == row.Table) &&
+		(f.Scope == 0 || f.Scope == row.Scope) &&
+		(f.PrimaryKey == 0 || f.PrimaryKey == row.Key)
+}
+
+func (f DiffFilter) matchesTableScope(row *TableScopeRow) bool {
+	return (f.Account == 0 || f.Account == row.Account) &&
+		(f.Table == 0 || f.Table == row.Table) &&
+		(f.Scope == 0 || f.Scope == row.Scope)
+}
+
+func (f DiffFilter) matchesKeyAccount(row *KeyAccountRow) bool {
+	// KeyAccountRow has no table/scope/primary key of its own, so only the
+	// account predicate applies here.
+	return f.Account == 0 || f.Account == row.Account
+}
+
+// matchesAccount is matchesKeyAccount's check, reused for the
+// permission-graph rows below - they too carry only an Account, no
+// table/scope/primary key.
+func (f DiffFilter) matchesAccount(account eos.Name) bool {
+	return f.Account == 0 || f.Account == account
+}
+
+// apply returns the subset of req matched by f, or nil if nothing in req
+// matches (so the caller knows to skip an empty delivery).
+func (f DiffFilter) apply(req *WriteRequest) *WriteRequest {
+	if f.isEmpty() {
+		return req
+	}
+
+	out := &WriteRequest{}
+	for _, row := range req.TableDatas {
+		if f.matchesTableData(row) {
+			out.TableDatas = append(out.TableDatas, row)
+		}
+	}
+	for _, row := range req.TableScopes {
+		if f.matchesTableScope(row) {
+			out.TableScopes = append(out.TableScopes, row)
+		}
+	}
+	for _, row := range req.KeyAccounts {
+		if f.matchesKeyAccount(row) {
+			out.KeyAccounts = append(out.KeyAccounts, row)
+		}
+	}
+	for _, row := range req.AccountPermissionLinks {
+		if f.matchesAccount(row.Account) {
+			out.AccountPermissionLinks = append(out.AccountPermissionLinks, row)
+		}
+	}
+	for _, row := range req.PermissionMetas {
+		if f.matchesAccount(row.Account) {
+			out.PermissionMetas = append(out.PermissionMetas, row)
+		}
+	}
+	for _, row := range req.Authorities {
+		if f.matchesAccount(row.Account) {
+			out.Authorities = append(out.Authorities, row)
+		}
+	}
+
+	if len(out.TableDatas) == 0 && len(out.TableScopes) == 0 && len(out.KeyAccounts) == 0 &&
+		len(out.AccountPermissionLinks) == 0 && len(out.PermissionMetas) == 0 && len(out.Authorities) == 0 {
+		return nil
+	}
+	return out
+}
+
+// DiffSubscription is a single client's live feed of WriteRequest diffs,
+// narrowed down to Filter. Callers read from Stream until they Unsubscribe.
+type DiffSubscription struct {
+	Filter DiffFilter
+
+	stream chan *WriteRequest
+}
+
+func (s *DiffSubscription) Stream() <-chan *WriteRequest {
+	return s.stream
+}
+
+// BlockFetcher abstracts the archive store that historical replay reads raw
+// blocks from (merged blocks files, a block log, etc.), so DiffHub doesn't
+// need to know how blocks are archived.
+type BlockFetcher interface {
+	GetBlock(ctx context.Context, blockNum uint64) (*pbcodec.Block, error)
+	GetBlockByID(ctx context.Context, blockID string) (*pbcodec.Block, error)
+}
+
+// DiffHub fans out each block's WriteRequest, produced by PreprocessBlock,
+// to any number of live subscribers, optionally filtered down to the rows
+// they care about. It also re-runs PreprocessBlock against an archived raw
+// block on demand, so a client that joined late can backfill by replaying
+// diffs instead of polling get_table_rows.
+type DiffHub struct {
+	fetcher BlockFetcher
+
+	mu            sync.Mutex
+	subscriptions map[*DiffSubscription]bool
+}
+
+func NewDiffHub(fetcher BlockFetcher) *DiffHub {
+	return &DiffHub{
+		fetcher:       fetcher,
+		subscriptions: make(map[*DiffSubscription]bool),
+	}
+}
+
+// Subscribe registers a new live subscriber. The returned subscription's
+// channel is buffered so a momentarily slow consumer doesn't stall
+// Publish; a consumer that falls too far behind has diffs dropped instead
+// (see Publish).
+func (h *DiffHub) Subscribe(filter DiffFilter) *DiffSubscription {
+	sub := &DiffSubscription{
+		Filter: filter,
+		stream: make(chan *WriteRequest, 100),
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.subscriptions[sub] = true
+
+	return sub
+}
+
+func (h *DiffHub) Unsubscribe(sub *DiffSubscription) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscriptions[sub] {
+		delete(h.subscriptions, sub)
+		close(sub.stream)
+	}
+}
+
+// Publish broadcasts a block's write request to every subscriber whose
+// filter matches at least one row in it; each subscriber only receives the
+// rows it asked for. It is meant to be called right after PreprocessBlock,
+// from the same pipeline stage that persists the diff.
+func (h *DiffHub) Publish(req *WriteRequest) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for sub := range h.subscriptions {
+		filtered := sub.Filter.apply(req)
+		if filtered == nil {
+			continue
+		}
+
+		select {
+		case sub.stream <- filtered:
+		default:
+			// Slow consumer; drop the diff rather than stall the pipeline.
+		}
+	}
+}
+
+// StateDiffAt re-runs PreprocessBlock against the archived raw block at
+// blockNum and returns the WriteRequest it would have produced live. It
+// lets downstream indexers materialize full state at any height by
+// accumulating diffs rather than polling get_table_rows.
+func (h *DiffHub) StateDiffAt(ctx context.Context, blockNum uint64) (*WriteRequest, error) {
+	blk, err := h.fetcher.GetBlock(ctx, blockNum)
+	if err != nil {
+		return nil, fmt.Errorf("fetching block %d: %w", blockNum, err)
+	}
+
+	return preprocessArchivedBlock(blk)
+}
+
+// StateDiffForHash is StateDiffAt by block ID instead of block number, for
+// callers walking a specific (possibly forked) branch.
+func (h *DiffHub) StateDiffForHash(ctx context.Context, blockID string) (*WriteRequest, error) {
+	blk, err := h.fetcher.GetBlockByID(ctx, blockID)
+	if err != nil {
+		return nil, fmt.Errorf("fetching block %s: %w", blockID, err)
+	}
+
+	return preprocessArchivedBlock(blk)
+}
+
+func preprocessArchivedBlock(blk *pbcodec.Block) (*WriteRequest, error) {
+	bstreamBlock, err := codec.BlockFromProto(blk)
+	if err != nil {
+		return nil, fmt.Errorf("converting archived block to bstream block: %w", err)
+	}
+
+	req, err := PreprocessBlock(bstreamBlock)
+	if err != nil {
+		return nil, fmt.Errorf("preprocessing archived block: %w", err)
+	}
+
+	return req.(*WriteRequest), nil
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffHub_PublishFiltersRows(t *testing.T) {
+	req := &WriteRequest{
+		TableDatas: []*TableDataRow{
+			{N("eosio"), N("scope"), N("table1"), N("key1"), N("payer1"), false, []byte("d1")},
+			{N("john"), N("scope"), N("table2"), N("key2"), N("payer2"), false, []byte("d2")},
+		},
+	}
+
+	hub := NewDiffHub(nil)
+	sub := hub.Subscribe(DiffFilter{Account: N("eosio")})
+	defer hub.Unsubscribe(sub)
+
+	hub.Publish(req)
+
+	select {
+	case got := <-sub.Stream():
+		assert.Len(t, got.TableDatas, 1)
+		assert.Equal(t, N("eosio"), got.TableDatas[0].Code)
+	case <-time.After(time.Second):
+		t.Fatal("expected a filtered diff on the subscription channel")
+	}
+}
+
+func TestDiffHub_PublishFiltersPermissionRows(t *testing.T) {
+	req := &WriteRequest{
+		AccountPermissionLinks: []*AccountPermissionLinkRow{
+			{N("eosio"), N("active"), N("bob"), N("active"), 1, false},
+			{N("john"), N("active"), N("bob"), N("active"), 1, false},
+		},
+		PermissionMetas: []*PermissionMetaRow{
+			{N("eosio"), N("active"), N("owner"), 1, false},
+			{N("john"), N("active"), N("owner"), 1, false},
+		},
+		Authorities: []*AuthorityRow{
+			{N("eosio"), N("active"), AuthoritySubjectKey, "k1", 1, false},
+			{N("john"), N("active"), AuthoritySubjectKey, "k2", 1, false},
+		},
+	}
+
+	hub := NewDiffHub(nil)
+	sub := hub.Subscribe(DiffFilter{Account: N("eosio")})
+	defer hub.Unsubscribe(sub)
+
+	hub.Publish(req)
+
+	select {
+	case got := <-sub.Stream():
+		require.Len(t, got.AccountPermissionLinks, 1)
+		assert.Equal(t, N("eosio"), got.AccountPermissionLinks[0].Account)
+		require.Len(t, got.PermissionMetas, 1)
+		assert.Equal(t, N("eosio"), got.PermissionMetas[0].Account)
+		require.Len(t, got.Authorities, 1)
+		assert.Equal(t, N("eosio"), got.Authorities[0].Account)
+	case <-time.After(time.Second):
+		t.Fatal("expected a filtered diff on the subscription channel")
+	}
+}
+
+func TestDiffHub_PublishDropsNonMatchingBlock(t *testing.T) {
+	req := &WriteRequest{
+		TableDatas: []*TableDataRow{
+			{N("eosio"), N("scope"), N("table1"), N("key1"), N("payer1"), false, []byte("d1")},
+		},
+	}
+
+	hub := NewDiffHub(nil)
+	sub := hub.Subscribe(DiffFilter{Account: N("john")})
+	defer hub.Unsubscribe(sub)
+
+	hub.Publish(req)
+
+	select {
+	case <-sub.Stream():
+		t.Fatal("non-matching diff should not have been delivered")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestDiffHub_EmptyFilterMatchesEverything(t *testing.T) {
+	req := &WriteRequest{
+		KeyAccounts: []*KeyAccountRow{
+			{"k1", N("eosio"), N("owner"), false},
+		},
+	}
+
+	hub := NewDiffHub(nil)
+	sub := hub.Subscribe(DiffFilter{})
+	defer hub.Unsubscribe(sub)
+
+	hub.Publish(req)
+
+	select {
+	case got := <-sub.Stream():
+		assert.Equal(t, req, got)
+	case <-time.After(time.Second):
+		t.Fatal("expected the unfiltered diff on the subscription channel")
+	}
+}
+
+func TestDiffHub_StateDiffAt(t *testing.T) {
+	blk := newBlock("0000003a", []string{"1"})
+	blk.TransactionTraces[0].DbOps = []*pbcodec.DBOp{
+		testDBOp("INS", "eosio/scope/table1/key1", "/payer1", "/d1"),
+	}
+
+	fetcher := &fakeBlockFetcher{blocksByNum: map[uint64]*pbcodec.Block{58: blk}}
+	hub := NewDiffHub(fetcher)
+
+	req, err := hub.StateDiffAt(context.Background(), 58)
+	require.NoError(t, err)
+	assert.Len(t, req.TableDatas, 1)
+	assert.Equal(t, N("eosio"), req.TableDatas[0].Code)
+
+	reqByHash, err := hub.StateDiffForHash(context.Background(), "0000003a")
+	require.NoError(t, err)
+	assert.Equal(t, req, reqByHash)
+}
+
+type fakeBlockFetcher struct {
+	blocksByNum map[uint64]*pbcodec.Block
+}
+
+func (f *fakeBlockFetcher) GetBlock(ctx context.Context, blockNum uint64) (*pbcodec.Block, error) {
+	return f.blocksByNum[blockNum], nil
+}
+
+func (f *fakeBlockFetcher) GetBlockByID(ctx context.Context, blockID string) (*pbcodec.Block, error) {
+	for _, blk := range f.blocksByNum {
+		if blk.Id == blockID {
+			return blk, nil
+		}
+	}
+	return nil, nil
+}
@@ -0,0 +1,245 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"github.com/eoscanada/eos-go"
+)
+
+// rowPredicate is one compiled allow-rule. A zero field matches any value;
+// Code/Table/Scope/PrimaryKey are compiled to eos.Name once up front so
+// matching an op is a handful of uint64 comparisons, never a string
+// compare or glob match.
+type rowPredicate struct {
+	code, table, scope, primaryKey eos.Name
+	dataPrefix                     []byte
+
+	// Kept only for Explain(); matching never touches these.
+	source FilterPredicate
+}
+
+func (p rowPredicate) matches(code, table, scope, primaryKey eos.Name, data []byte) bool {
+	return (p.code == 0 || p.code == code) &&
+		(p.table == 0 || p.table == table) &&
+		(p.scope == 0 || p.scope == scope) &&
+		(p.primaryKey == 0 || p.primaryKey == primaryKey) &&
+		(len(p.dataPrefix) == 0 || bytes.HasPrefix(data, p.dataPrefix))
+}
+
+// FilterPredicate is one user-supplied allow-rule before compilation. Code,
+// Table, Scope and PrimaryKey accept "" or "*" to mean match-any; any other
+// value must match exactly.
+type FilterPredicate struct {
+	Code       string
+	Table      string
+	Scope      string
+	PrimaryKey string
+	DataPrefix []byte
+}
+
+// PreprocessFilter is a compiled set of FilterPredicates plus payer
+// allow/deny lists. Pass it to PreprocessBlockWithFilter to drop
+// non-matching DBOp/TableOp/PermOp rows before they are added to the
+// WriteRequest, so a shard never writes to disk the rows it isn't keeping.
+// Projection changes only what Explain reports; the same rows are dropped
+// whether it is set or not. Apply, below, re-applies
+// the same predicates to an already-built WriteRequest (e.g. one replayed
+// by DiffHub.StateDiffAt) for a narrower read-time view.
+type PreprocessFilter struct {
+	predicates []rowPredicate
+	payerAllow map[eos.Name]bool
+	payerDeny  map[eos.Name]bool
+	Projection bool
+}
+
+// CompileFilter compiles predicates and payer lists once, so every block
+// is matched against plain comparisons instead of re-parsing globs or
+// re-resolving names per op.
+func CompileFilter(predicates []FilterPredicate, payerAllow, payerDeny []string, projection bool) *PreprocessFilter {
+	f := &PreprocessFilter{Projection: projection}
+
+	for _, p := range predicates {
+		f.predicates = append(f.predicates, rowPredicate{
+			code:       compileGlob(p.Code),
+			table:      compileGlob(p.Table),
+			scope:      compileGlob(p.Scope),
+			primaryKey: compileGlob(p.PrimaryKey),
+			dataPrefix: p.DataPrefix,
+			source:     p,
+		})
+	}
+
+	if len(payerAllow) > 0 {
+		f.payerAllow = make(map[eos.Name]bool, len(payerAllow))
+		for _, payer := range payerAllow {
+			f.payerAllow[N(payer)] = true
+		}
+	}
+	if len(payerDeny) > 0 {
+		f.payerDeny = make(map[eos.Name]bool, len(payerDeny))
+		for _, payer := range payerDeny {
+			f.payerDeny[N(payer)] = true
+		}
+	}
+
+	return f
+}
+
+func compileGlob(value string) eos.Name {
+	if value == "" || value == "*" {
+		return 0
+	}
+	return N(value)
+}
+
+func (f *PreprocessFilter) payerAllowed(payer eos.Name) bool {
+	if f.payerDeny[payer] {
+		return false
+	}
+	if len(f.payerAllow) == 0 {
+		return true
+	}
+	return f.payerAllow[payer]
+}
+
+func (f *PreprocessFilter) matchesAny(code, table, scope, primaryKey eos.Name, data []byte) bool {
+	if len(f.predicates) == 0 {
+		return true
+	}
+	for _, p := range f.predicates {
+		if p.matches(code, table, scope, primaryKey, data) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *PreprocessFilter) matchesTableData(row *TableDataRow) bool {
+	return f.payerAllowed(row.Payer) && f.matchesAny(row.Code, row.Table, row.Scope, row.Key, row.Data)
+}
+
+func (f *PreprocessFilter) matchesTableScope(row *TableScopeRow) bool {
+	return f.payerAllowed(row.Payer) && f.matchesAny(row.Account, row.Table, row.Scope, 0, nil)
+}
+
+// matchesAccount matches a bare account name against f's Code predicates,
+// for rows - KeyAccounts and the permission-graph rows - that have no
+// table/scope/primary key of their own, only an account they're about.
+// Payer allow/deny lists don't apply to them either, for the same reason.
+func (f *PreprocessFilter) matchesAccount(account eos.Name) bool {
+	if len(f.predicates) == 0 {
+		return true
+	}
+	for _, p := range f.predicates {
+		if p.code == 0 || p.code == account {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesKeyAccount matches a KeyAccountRow against f's Code predicates; see
+// matchesAccount.
+func (f *PreprocessFilter) matchesKeyAccount(row *KeyAccountRow) bool {
+	return f.matchesAccount(row.Account)
+}
+
+// Apply re-filters an already-built WriteRequest down to the rows matching
+// f, for callers (like a replayed historical diff) that didn't go through
+// PreprocessBlockWithFilter in the first place. KeyAccounts and the
+// permission-graph rows are matched against f's Code predicates as "the
+// account this row is about" (see matchesAccount); they have no
+// table/scope/primary key for the rest of the predicate to apply to.
+func (f *PreprocessFilter) Apply(req *WriteRequest) *WriteRequest {
+	out := &WriteRequest{}
+
+	for _, row := range req.TableDatas {
+		if f.matchesTableData(row) {
+			out.TableDatas = append(out.TableDatas, row)
+		}
+	}
+	for _, row := range req.TableScopes {
+		if f.matchesTableScope(row) {
+			out.TableScopes = append(out.TableScopes, row)
+		}
+	}
+	for _, row := range req.KeyAccounts {
+		if f.matchesKeyAccount(row) {
+			out.KeyAccounts = append(out.KeyAccounts, row)
+		}
+	}
+	for _, row := range req.AccountPermissionLinks {
+		if f.matchesAccount(row.Account) {
+			out.AccountPermissionLinks = append(out.AccountPermissionLinks, row)
+		}
+	}
+	for _, row := range req.PermissionMetas {
+		if f.matchesAccount(row.Account) {
+			out.PermissionMetas = append(out.PermissionMetas, row)
+		}
+	}
+	for _, row := range req.Authorities {
+		if f.matchesAccount(row.Account) {
+			out.Authorities = append(out.Authorities, row)
+		}
+	}
+
+	return out
+}
+
+// Explain reports the compiled predicates in a human-readable form, for ops
+// dashboards that need to confirm a shard is filtering the way it was
+// configured to.
+func (f *PreprocessFilter) Explain() string {
+	var sb strings.Builder
+
+	if f.Projection {
+		sb.WriteString("projection mode: only matching rows are persisted\n")
+	}
+
+	if len(f.predicates) == 0 {
+		sb.WriteString("predicates: match all\n")
+	} else {
+		sb.WriteString("predicates:\n")
+		for _, p := range f.predicates {
+			sb.WriteString(fmt.Sprintf("  - code=%s table=%s scope=%s primary_key=%s",
+				orAny(p.source.Code), orAny(p.source.Table), orAny(p.source.Scope), orAny(p.source.PrimaryKey)))
+			if len(p.dataPrefix) > 0 {
+				sb.WriteString(fmt.Sprintf(" data_prefix=%x", p.dataPrefix))
+			}
+			sb.WriteString("\n")
+		}
+	}
+
+	if len(f.payerAllow) > 0 {
+		sb.WriteString(fmt.Sprintf("payer allow-list: %d accounts\n", len(f.payerAllow)))
+	}
+	if len(f.payerDeny) > 0 {
+		sb.WriteString(fmt.Sprintf("payer deny-list: %d accounts\n", len(f.payerDeny)))
+	}
+
+	return sb.String()
+}
+
+func orAny(value string) string {
+	if value == "" {
+		return "*"
+	}
+	return value
+}
@@ -0,0 +1,147 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreprocessFilter_Apply(t *testing.T) {
+	req := &WriteRequest{
+		TableDatas: []*TableDataRow{
+			{N("eosio.token"), N("alice"), N("accounts"), N("EOS"), N("alice"), false, []byte("d1")},
+			{N("eosio.token"), N("bob"), N("accounts"), N("EOS"), N("bob"), false, []byte("d2")},
+			{N("otherctrct"), N("alice"), N("accounts"), N("EOS"), N("alice"), false, []byte("d3")},
+		},
+	}
+
+	filter := CompileFilter([]FilterPredicate{{Code: "eosio.token", Table: "accounts"}}, nil, nil, false)
+	out := filter.Apply(req)
+
+	assert.Len(t, out.TableDatas, 2)
+	assert.Equal(t, N("eosio.token"), out.TableDatas[0].Code)
+	assert.Equal(t, N("eosio.token"), out.TableDatas[1].Code)
+}
+
+func TestPreprocessFilter_ApplyFiltersKeyAccounts(t *testing.T) {
+	req := &WriteRequest{
+		KeyAccounts: []*KeyAccountRow{
+			{"k1", N("eosio"), N("owner"), false},
+			{"k2", N("eosio.token"), N("active"), false},
+		},
+	}
+
+	filter := CompileFilter([]FilterPredicate{{Code: "eosio.token"}}, nil, nil, false)
+	out := filter.Apply(req)
+
+	require.Len(t, out.KeyAccounts, 1)
+	assert.Equal(t, N("eosio.token"), out.KeyAccounts[0].Account)
+}
+
+func TestPreprocessFilter_ApplyWithNoPredicatesKeepsAllKeyAccounts(t *testing.T) {
+	req := &WriteRequest{
+		KeyAccounts: []*KeyAccountRow{
+			{"k1", N("eosio"), N("owner"), false},
+		},
+	}
+
+	filter := CompileFilter(nil, nil, nil, false)
+	out := filter.Apply(req)
+
+	assert.Equal(t, req.KeyAccounts, out.KeyAccounts)
+}
+
+func TestPreprocessFilter_ApplyFiltersPermissionRows(t *testing.T) {
+	req := &WriteRequest{
+		AccountPermissionLinks: []*AccountPermissionLinkRow{
+			{N("eosio"), N("active"), N("bob"), N("active"), 1, false},
+			{N("eosio.token"), N("active"), N("bob"), N("active"), 1, false},
+		},
+		PermissionMetas: []*PermissionMetaRow{
+			{N("eosio"), N("active"), N("owner"), 1, false},
+			{N("eosio.token"), N("active"), N("owner"), 1, false},
+		},
+		Authorities: []*AuthorityRow{
+			{N("eosio"), N("active"), AuthoritySubjectKey, "k1", 1, false},
+			{N("eosio.token"), N("active"), AuthoritySubjectKey, "k2", 1, false},
+		},
+	}
+
+	filter := CompileFilter([]FilterPredicate{{Code: "eosio"}}, nil, nil, false)
+	out := filter.Apply(req)
+
+	require.Len(t, out.AccountPermissionLinks, 1)
+	assert.Equal(t, N("eosio"), out.AccountPermissionLinks[0].Account)
+	require.Len(t, out.PermissionMetas, 1)
+	assert.Equal(t, N("eosio"), out.PermissionMetas[0].Account)
+	require.Len(t, out.Authorities, 1)
+	assert.Equal(t, N("eosio"), out.Authorities[0].Account)
+}
+
+func TestPreprocessFilter_PayerDenyWinsOverAllow(t *testing.T) {
+	req := &WriteRequest{
+		TableDatas: []*TableDataRow{
+			{N("eosio.token"), N("alice"), N("accounts"), N("EOS"), N("alice"), false, []byte("d1")},
+		},
+	}
+
+	filter := CompileFilter(nil, []string{"alice"}, []string{"alice"}, false)
+	out := filter.Apply(req)
+
+	assert.Empty(t, out.TableDatas)
+}
+
+func TestPreprocessFilter_NoPredicatesMatchesEverything(t *testing.T) {
+	req := &WriteRequest{
+		TableDatas: []*TableDataRow{
+			{N("eosio.token"), N("alice"), N("accounts"), N("EOS"), N("alice"), false, []byte("d1")},
+		},
+	}
+
+	filter := CompileFilter(nil, nil, nil, false)
+	out := filter.Apply(req)
+
+	assert.Equal(t, req.TableDatas, out.TableDatas)
+}
+
+func TestPreprocessFilter_DataPrefix(t *testing.T) {
+	req := &WriteRequest{
+		TableDatas: []*TableDataRow{
+			{N("eosio.token"), N("alice"), N("accounts"), N("EOS"), N("alice"), false, []byte("EOSprefixed")},
+			{N("eosio.token"), N("alice"), N("accounts"), N("USD"), N("alice"), false, []byte("other")},
+		},
+	}
+
+	filter := CompileFilter([]FilterPredicate{{DataPrefix: []byte("EOS")}}, nil, nil, false)
+	out := filter.Apply(req)
+
+	assert.Len(t, out.TableDatas, 1)
+	assert.Equal(t, N("EOS"), out.TableDatas[0].Key)
+}
+
+func TestPreprocessFilter_Explain(t *testing.T) {
+	filter := CompileFilter([]FilterPredicate{{Code: "eosio.token", Table: "accounts"}}, []string{"alice"}, nil, true)
+
+	explanation := filter.Explain()
+
+	assert.Contains(t, explanation, "projection mode")
+	assert.Contains(t, explanation, "code=eosio.token")
+	assert.Contains(t, explanation, "table=accounts")
+	assert.Contains(t, explanation, "scope=*")
+	assert.Contains(t, explanation, "payer allow-list: 1 accounts")
+}
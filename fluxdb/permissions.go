@@ -0,0 +1,285 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"github.com/eoscanada/eos-go"
+)
+
+// AccountPermissionLinkRow records that linkedAccount@linkedPermission can
+// satisfy account@permission's authority, carrying the weight it
+// contributes toward that permission's threshold. Together with
+// AuthorityRow, this answers "which accounts can sign as eosio@active".
+type AccountPermissionLinkRow struct {
+	Account          eos.Name
+	Permission       eos.Name
+	LinkedAccount    eos.Name
+	LinkedPermission eos.Name
+	Weight           uint16
+	Deletion         bool
+}
+
+// PermissionMetaRow carries the parts of a PermissionObject that aren't
+// weighted subjects: its position in the permission tree and the threshold
+// its authority must reach to be satisfied.
+type PermissionMetaRow struct {
+	Account    eos.Name
+	Permission eos.Name
+	Parent     eos.Name
+	Threshold  uint32
+	Deletion   bool
+}
+
+// AuthoritySubjectKind distinguishes the three kinds of weighted subject an
+// authority threshold can be made of.
+type AuthoritySubjectKind int
+
+const (
+	AuthoritySubjectKey AuthoritySubjectKind = iota
+	AuthoritySubjectAccount
+	AuthoritySubjectWait
+)
+
+// AuthorityRow is a single weighted subject of an account@permission's
+// authority: a public key, a linked account permission, or a wait. Walking
+// every AuthorityRow (and AccountPermissionLinkRow) for an account
+// reconstructs its full authority tree at the block it was read at.
+type AuthorityRow struct {
+	Account    eos.Name
+	Permission eos.Name
+	Kind       AuthoritySubjectKind
+	Subject    string
+	Weight     uint16
+	Deletion   bool
+}
+
+// ExtractPermissionRows turns a block's PermOps into the authority graph
+// rows fluxdb indexes permissions as. It applies the same INS+REM gobbling
+// PreprocessBlock already does for DBOps: a permission created and removed
+// within the same block nets out to nothing. filter may be nil, in which
+// case every account's rows are kept; otherwise an account that doesn't
+// match filter contributes no meta/authority/link rows at all.
+func ExtractPermissionRows(permOps []*pbcodec.PermOp, filter *PreprocessFilter) (links []*AccountPermissionLinkRow, metas []*PermissionMetaRow, authorities []*AuthorityRow) {
+	accum := map[string]*permAccum{}
+	seenKeys := map[string]bool{}
+	var order []string
+
+	for _, op := range permOps {
+		perm := op.NewPerm
+		if perm == nil {
+			perm = op.OldPerm
+		}
+		if perm == nil {
+			continue
+		}
+
+		// order is keyed by seenKeys, not by presence in accum: a gobbled
+		// INS+REM deletes the accum entry (below) but must not free up its
+		// slot in order, or a later op on the same account@permission
+		// would be emitted a second time.
+		key := fmt.Sprintf("%s:%s", perm.Owner, perm.Name)
+		if !seenKeys[key] {
+			seenKeys[key] = true
+			order = append(order, key)
+		}
+
+		acc, ok := accum[key]
+		if !ok {
+			acc = &permAccum{account: N(perm.Owner), permission: N(perm.Name)}
+			accum[key] = acc
+		}
+
+		switch op.Operation {
+		case pbcodec.PermOp_OPERATION_INSERT:
+			acc.insertedInBlock = true
+			acc.latest = op.NewPerm
+			acc.deleted = false
+		case pbcodec.PermOp_OPERATION_UPDATE:
+			acc.latest = op.NewPerm
+		case pbcodec.PermOp_OPERATION_REMOVE:
+			if acc.insertedInBlock {
+				delete(accum, key)
+				continue
+			}
+			acc.latest = op.OldPerm
+			acc.deleted = true
+		}
+	}
+
+	for _, key := range order {
+		acc, ok := accum[key]
+		if !ok {
+			// Gobbled away by an INS+REM pair within this block.
+			continue
+		}
+		if acc.latest == nil {
+			continue
+		}
+		if filter != nil && !filter.matchesAccount(acc.account) {
+			continue
+		}
+
+		metas = append(metas, &PermissionMetaRow{
+			Account:    acc.account,
+			Permission: acc.permission,
+			Parent:     N(acc.latest.Parent),
+			Threshold:  authorityThreshold(acc.latest.Authority),
+			Deletion:   acc.deleted,
+		})
+
+		if acc.latest.Authority == nil {
+			continue
+		}
+
+		for _, kw := range acc.latest.Authority.Keys {
+			authorities = append(authorities, &AuthorityRow{
+				Account: acc.account, Permission: acc.permission,
+				Kind: AuthoritySubjectKey, Subject: kw.PublicKey,
+				Weight: uint16(kw.Weight), Deletion: acc.deleted,
+			})
+		}
+
+		for _, wait := range acc.latest.Authority.Waits {
+			authorities = append(authorities, &AuthorityRow{
+				Account: acc.account, Permission: acc.permission,
+				Kind: AuthoritySubjectWait, Subject: fmt.Sprintf("%d", wait.WaitSec),
+				Weight: uint16(wait.Weight), Deletion: acc.deleted,
+			})
+		}
+
+		for _, pl := range acc.latest.Authority.Accounts {
+			links = append(links, &AccountPermissionLinkRow{
+				Account: acc.account, Permission: acc.permission,
+				LinkedAccount:    N(pl.Permission.Actor),
+				LinkedPermission: N(pl.Permission.Permission),
+				Weight:           uint16(pl.Weight),
+				Deletion:         acc.deleted,
+			})
+			authorities = append(authorities, &AuthorityRow{
+				Account: acc.account, Permission: acc.permission,
+				Kind:     AuthoritySubjectAccount,
+				Subject:  fmt.Sprintf("%s@%s", pl.Permission.Actor, pl.Permission.Permission),
+				Weight:   uint16(pl.Weight),
+				Deletion: acc.deleted,
+			})
+		}
+	}
+
+	return links, metas, authorities
+}
+
+type permAccum struct {
+	account         eos.Name
+	permission      eos.Name
+	insertedInBlock bool
+	latest          *pbcodec.PermissionObject
+	deleted         bool
+}
+
+func authorityThreshold(auth *pbcodec.Authority) uint32 {
+	if auth == nil {
+		return 0
+	}
+	return auth.Threshold
+}
+
+// PermissionReader is the read side of the authority graph this file
+// writes rows for: a backend that persisted PermissionMetaRow/AuthorityRow/
+// AccountPermissionLinkRow (such as the Postgres sink's Reader) is queried
+// through it.
+type PermissionReader interface {
+	Authorities(ctx context.Context, account, permission eos.Name, blockNum uint64) ([]*AuthorityRow, error)
+	AccountLinksInto(ctx context.Context, account, permission eos.Name, blockNum uint64) ([]*AccountPermissionLinkRow, error)
+}
+
+// SignersFor answers "which accounts can sign as account@permission",
+// walking AccountPermissionLinkRow edges transitively: if bob@active is
+// linked into eosio@active's authority, and carol@owner is linked into
+// bob@active's authority, carol@owner can sign as eosio@active too.
+func SignersFor(ctx context.Context, r PermissionReader, account, permission eos.Name, blockNum uint64) ([]*AccountPermissionLinkRow, error) {
+	var signers []*AccountPermissionLinkRow
+	visited := map[string]bool{}
+
+	var walk func(account, permission eos.Name) error
+	walk = func(account, permission eos.Name) error {
+		key := fmt.Sprintf("%d:%d", account, permission)
+		if visited[key] {
+			return nil
+		}
+		visited[key] = true
+
+		links, err := r.AccountLinksInto(ctx, account, permission, blockNum)
+		if err != nil {
+			return fmt.Errorf("reading account links into %s@%s: %w", eos.NameToString(account), eos.NameToString(permission), err)
+		}
+
+		for _, link := range links {
+			signers = append(signers, link)
+			if err := walk(link.LinkedAccount, link.LinkedPermission); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(account, permission); err != nil {
+		return nil, err
+	}
+	return signers, nil
+}
+
+// AuthorityTreeAt returns every AuthorityRow needed to answer "what is the
+// full authority tree of account@permission at block N", including the
+// authorities of every account transitively linked into it through
+// AccountPermissionLinkRow.
+func AuthorityTreeAt(ctx context.Context, r PermissionReader, account, permission eos.Name, blockNum uint64) ([]*AuthorityRow, error) {
+	var tree []*AuthorityRow
+	visited := map[string]bool{}
+
+	var walk func(account, permission eos.Name) error
+	walk = func(account, permission eos.Name) error {
+		key := fmt.Sprintf("%d:%d", account, permission)
+		if visited[key] {
+			return nil
+		}
+		visited[key] = true
+
+		authorities, err := r.Authorities(ctx, account, permission, blockNum)
+		if err != nil {
+			return fmt.Errorf("reading authorities for %s@%s: %w", eos.NameToString(account), eos.NameToString(permission), err)
+		}
+		tree = append(tree, authorities...)
+
+		links, err := r.AccountLinksInto(ctx, account, permission, blockNum)
+		if err != nil {
+			return fmt.Errorf("reading account links into %s@%s: %w", eos.NameToString(account), eos.NameToString(permission), err)
+		}
+		for _, link := range links {
+			if err := walk(link.LinkedAccount, link.LinkedPermission); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	if err := walk(account, permission); err != nil {
+		return nil, err
+	}
+	return tree, nil
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExtractPermissionRows_FullAuthority(t *testing.T) {
+	permOps := []*pbcodec.PermOp{
+		newFullPermOp("INS", nil, &pbcodec.PermissionObject{
+			Owner:  "eosio",
+			Name:   "active",
+			Parent: "owner",
+			Authority: &pbcodec.Authority{
+				Threshold: 2,
+				Keys:      []*pbcodec.KeyWeight{{PublicKey: "k1", Weight: 1}},
+				Waits:     []*pbcodec.WaitWeight{{WaitSec: 3600, Weight: 1}},
+				Accounts: []*pbcodec.PermissionLevelWeight{
+					{Permission: &pbcodec.PermissionLevel{Actor: "bob", Permission: "active"}, Weight: 1},
+				},
+			},
+		}),
+	}
+
+	links, metas, authorities := ExtractPermissionRows(permOps, nil)
+
+	assert.Equal(t, []*PermissionMetaRow{
+		{N("eosio"), N("active"), N("owner"), 2, false},
+	}, metas)
+
+	assert.Equal(t, []*AccountPermissionLinkRow{
+		{N("eosio"), N("active"), N("bob"), N("active"), 1, false},
+	}, links)
+
+	assert.Equal(t, []*AuthorityRow{
+		{N("eosio"), N("active"), AuthoritySubjectKey, "k1", 1, false},
+		{N("eosio"), N("active"), AuthoritySubjectWait, "3600", 1, false},
+		{N("eosio"), N("active"), AuthoritySubjectAccount, "bob@active", 1, false},
+	}, authorities)
+}
+
+func TestExtractPermissionRows_GobblesInsertThenRemove(t *testing.T) {
+	perm := &pbcodec.PermissionObject{Owner: "eosio", Name: "active", Authority: &pbcodec.Authority{}}
+	permOps := []*pbcodec.PermOp{
+		newFullPermOp("INS", nil, perm),
+		newFullPermOp("REM", perm, nil),
+	}
+
+	links, metas, authorities := ExtractPermissionRows(permOps, nil)
+
+	assert.Nil(t, links)
+	assert.Nil(t, metas)
+	assert.Nil(t, authorities)
+}
+
+func TestExtractPermissionRows_InsertRemoveInsertDoesNotDuplicateRows(t *testing.T) {
+	firstInsert := &pbcodec.PermissionObject{
+		Owner: "eosio", Name: "active", Parent: "owner",
+		Authority: &pbcodec.Authority{Threshold: 1, Keys: []*pbcodec.KeyWeight{{PublicKey: "k1", Weight: 1}}},
+	}
+	secondInsert := &pbcodec.PermissionObject{
+		Owner: "eosio", Name: "active", Parent: "owner",
+		Authority: &pbcodec.Authority{Threshold: 1, Keys: []*pbcodec.KeyWeight{{PublicKey: "k2", Weight: 1}}},
+	}
+
+	permOps := []*pbcodec.PermOp{
+		newFullPermOp("INS", nil, firstInsert),
+		newFullPermOp("REM", firstInsert, nil),
+		newFullPermOp("INS", nil, secondInsert),
+	}
+
+	_, metas, authorities := ExtractPermissionRows(permOps, nil)
+
+	assert.Equal(t, []*PermissionMetaRow{
+		{N("eosio"), N("active"), N("owner"), 1, false},
+	}, metas, "the re-created permission must be emitted exactly once")
+	assert.Equal(t, []*AuthorityRow{
+		{N("eosio"), N("active"), AuthoritySubjectKey, "k2", 1, false},
+	}, authorities)
+}
+
+func TestExtractPermissionRows_RemoveWithoutPriorInsertIsADeletion(t *testing.T) {
+	perm := &pbcodec.PermissionObject{
+		Owner: "eosio", Name: "active", Parent: "owner",
+		Authority: &pbcodec.Authority{Threshold: 1, Keys: []*pbcodec.KeyWeight{{PublicKey: "k1", Weight: 1}}},
+	}
+	permOps := []*pbcodec.PermOp{
+		newFullPermOp("REM", perm, nil),
+	}
+
+	links, metas, authorities := ExtractPermissionRows(permOps, nil)
+
+	assert.Nil(t, links)
+	assert.Equal(t, []*PermissionMetaRow{
+		{N("eosio"), N("active"), N("owner"), 1, true},
+	}, metas)
+	assert.Equal(t, []*AuthorityRow{
+		{N("eosio"), N("active"), AuthoritySubjectKey, "k1", 1, true},
+	}, authorities)
+}
+
+func TestExtractPermissionRows_FiltersByAccount(t *testing.T) {
+	permOps := []*pbcodec.PermOp{
+		newFullPermOp("INS", nil, &pbcodec.PermissionObject{
+			Owner: "eosio", Name: "active", Parent: "owner",
+			Authority: &pbcodec.Authority{Threshold: 1, Keys: []*pbcodec.KeyWeight{{PublicKey: "k1", Weight: 1}}},
+		}),
+		newFullPermOp("INS", nil, &pbcodec.PermissionObject{
+			Owner: "bob", Name: "active", Parent: "owner",
+			Authority: &pbcodec.Authority{Threshold: 1, Keys: []*pbcodec.KeyWeight{{PublicKey: "k2", Weight: 1}}},
+		}),
+	}
+
+	filter := CompileFilter([]FilterPredicate{{Code: "eosio"}}, nil, nil, false)
+	links, metas, authorities := ExtractPermissionRows(permOps, filter)
+
+	assert.Nil(t, links)
+	assert.Equal(t, []*PermissionMetaRow{
+		{N("eosio"), N("active"), N("owner"), 1, false},
+	}, metas)
+	assert.Equal(t, []*AuthorityRow{
+		{N("eosio"), N("active"), AuthoritySubjectKey, "k1", 1, false},
+	}, authorities)
+}
+
+type fakePermissionReader struct {
+	authorities map[string][]*AuthorityRow
+	links       map[string][]*AccountPermissionLinkRow
+}
+
+func permKey(account, permission eos.Name) string {
+	return fmt.Sprintf("%d:%d", account, permission)
+}
+
+func (r *fakePermissionReader) Authorities(ctx context.Context, account, permission eos.Name, blockNum uint64) ([]*AuthorityRow, error) {
+	return r.authorities[permKey(account, permission)], nil
+}
+
+func (r *fakePermissionReader) AccountLinksInto(ctx context.Context, account, permission eos.Name, blockNum uint64) ([]*AccountPermissionLinkRow, error) {
+	return r.links[permKey(account, permission)], nil
+}
+
+func TestSignersFor_WalksLinksTransitively(t *testing.T) {
+	reader := &fakePermissionReader{
+		links: map[string][]*AccountPermissionLinkRow{
+			permKey(N("eosio"), N("active")): {
+				{Account: N("eosio"), Permission: N("active"), LinkedAccount: N("bob"), LinkedPermission: N("active"), Weight: 1},
+			},
+			permKey(N("bob"), N("active")): {
+				{Account: N("bob"), Permission: N("active"), LinkedAccount: N("carol"), LinkedPermission: N("owner"), Weight: 1},
+			},
+		},
+	}
+
+	signers, err := SignersFor(context.Background(), reader, N("eosio"), N("active"), 100)
+	require.NoError(t, err)
+	require.Len(t, signers, 2)
+	assert.Equal(t, N("bob"), signers[0].LinkedAccount)
+	assert.Equal(t, N("carol"), signers[1].LinkedAccount)
+}
+
+func TestAuthorityTreeAt_CollectsAuthoritiesAcrossLinks(t *testing.T) {
+	reader := &fakePermissionReader{
+		authorities: map[string][]*AuthorityRow{
+			permKey(N("eosio"), N("active")): {
+				{Account: N("eosio"), Permission: N("active"), Kind: AuthoritySubjectAccount, Subject: "bob@active", Weight: 1},
+			},
+			permKey(N("bob"), N("active")): {
+				{Account: N("bob"), Permission: N("active"), Kind: AuthoritySubjectKey, Subject: "k1", Weight: 1},
+			},
+		},
+		links: map[string][]*AccountPermissionLinkRow{
+			permKey(N("eosio"), N("active")): {
+				{Account: N("eosio"), Permission: N("active"), LinkedAccount: N("bob"), LinkedPermission: N("active"), Weight: 1},
+			},
+		},
+	}
+
+	tree, err := AuthorityTreeAt(context.Background(), reader, N("eosio"), N("active"), 100)
+	require.NoError(t, err)
+	require.Len(t, tree, 2)
+	assert.Equal(t, "bob@active", tree[0].Subject)
+	assert.Equal(t, "k1", tree[1].Subject)
+}
+
+func newFullPermOp(operation string, oldPerm, newPerm *pbcodec.PermissionObject) *pbcodec.PermOp {
+	pbcodecOperation := pbcodec.PermOp_OPERATION_UNKNOWN
+	switch operation {
+	case "INS":
+		pbcodecOperation = pbcodec.PermOp_OPERATION_INSERT
+	case "UPD":
+		pbcodecOperation = pbcodec.PermOp_OPERATION_UPDATE
+	case "REM":
+		pbcodecOperation = pbcodec.PermOp_OPERATION_REMOVE
+	}
+
+	return &pbcodec.PermOp{
+		Operation: pbcodecOperation,
+		OldPerm:   oldPerm,
+		NewPerm:   newPerm,
+	}
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+
+	"github.com/dfuse-io/dfuse-eosio/fluxdb"
+	"github.com/eoscanada/eos-go"
+)
+
+// Reader serves fluxdb.PermissionReader (SignersFor, AuthorityTreeAt) out
+// of the authority/account_permission_link tables Writer populates. Unlike
+// Writer, it only reads, so it takes no transaction.
+type Reader struct {
+	db *sql.DB
+}
+
+func NewReader(db *sql.DB) *Reader {
+	return &Reader{db: db}
+}
+
+// Authorities returns account@permission's weighted subjects as of
+// blockNum: for each (kind, subject) it keeps only the most recent row at
+// or before blockNum, and drops it if that row was a deletion.
+func (r *Reader) Authorities(ctx context.Context, account, permission eos.Name, blockNum uint64) ([]*fluxdb.AuthorityRow, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT DISTINCT ON (kind, subject) kind, subject, weight, deletion
+		FROM authority
+		WHERE account = $1 AND permission = $2 AND block_num <= $3
+		ORDER BY kind, subject, block_num DESC`,
+		eos.NameToString(account), eos.NameToString(permission), blockNum,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying authorities for %s@%s: %w", eos.NameToString(account), eos.NameToString(permission), err)
+	}
+	defer rows.Close()
+
+	var out []*fluxdb.AuthorityRow
+	for rows.Next() {
+		var kind fluxdb.AuthoritySubjectKind
+		var subject string
+		var weight uint16
+		var deletion bool
+		if err := rows.Scan(&kind, &subject, &weight, &deletion); err != nil {
+			return nil, fmt.Errorf("scanning authority row: %w", err)
+		}
+		if deletion {
+			continue
+		}
+		out = append(out, &fluxdb.AuthorityRow{
+			Account: account, Permission: permission,
+			Kind: kind, Subject: subject, Weight: weight,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading authority rows: %w", err)
+	}
+	return out, nil
+}
+
+// AccountLinksInto returns the accounts linked into account@permission's
+// authority as of blockNum, keeping the same "most recent row wins, drop
+// if it was a deletion" rule as Authorities.
+func (r *Reader) AccountLinksInto(ctx context.Context, account, permission eos.Name, blockNum uint64) ([]*fluxdb.AccountPermissionLinkRow, error) {
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT DISTINCT ON (linked_account, linked_permission) linked_account, linked_permission, weight, deletion
+		FROM account_permission_link
+		WHERE account = $1 AND permission = $2 AND block_num <= $3
+		ORDER BY linked_account, linked_permission, block_num DESC`,
+		eos.NameToString(account), eos.NameToString(permission), blockNum,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("querying account links into %s@%s: %w", eos.NameToString(account), eos.NameToString(permission), err)
+	}
+	defer rows.Close()
+
+	var out []*fluxdb.AccountPermissionLinkRow
+	for rows.Next() {
+		var linkedAccount, linkedPermission string
+		var weight uint16
+		var deletion bool
+		if err := rows.Scan(&linkedAccount, &linkedPermission, &weight, &deletion); err != nil {
+			return nil, fmt.Errorf("scanning account_permission_link row: %w", err)
+		}
+		if deletion {
+			continue
+		}
+		out = append(out, &fluxdb.AccountPermissionLinkRow{
+			Account: account, Permission: permission,
+			LinkedAccount: fluxdb.N(linkedAccount), LinkedPermission: fluxdb.N(linkedPermission),
+			Weight: weight,
+		})
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("reading account_permission_link rows: %w", err)
+	}
+	return out, nil
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"regexp"
+	"testing"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/dfuse-io/dfuse-eosio/fluxdb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReader_Authorities_DropsMostRecentRowIfItWasADeletion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT ON (kind, subject) kind, subject, weight, deletion FROM authority`)).
+		WillReturnRows(sqlmock.NewRows([]string{"kind", "subject", "weight", "deletion"}).
+			AddRow(int(fluxdb.AuthoritySubjectKey), "k1", 1, false).
+			AddRow(int(fluxdb.AuthoritySubjectKey), "k2", 1, true))
+
+	r := NewReader(db)
+	authorities, err := r.Authorities(context.Background(), N("eosio"), N("active"), 100)
+	require.NoError(t, err)
+	require.Len(t, authorities, 1)
+	assert.Equal(t, "k1", authorities[0].Subject)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestReader_AccountLinksInto_DropsMostRecentRowIfItWasADeletion(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT DISTINCT ON (linked_account, linked_permission) linked_account, linked_permission, weight, deletion FROM account_permission_link`)).
+		WillReturnRows(sqlmock.NewRows([]string{"linked_account", "linked_permission", "weight", "deletion"}).
+			AddRow("bob", "active", 1, false).
+			AddRow("carol", "owner", 1, true))
+
+	r := NewReader(db)
+	links, err := r.AccountLinksInto(context.Background(), N("eosio"), N("active"), 100)
+	require.NoError(t, err)
+	require.Len(t, links, 1)
+	assert.Equal(t, N("bob"), links[0].LinkedAccount)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
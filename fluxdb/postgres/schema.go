@@ -0,0 +1,118 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+// Schema holds the DDL for the seven hypertables this sink writes to, plus
+// the plain account_operation_count table. It is
+// not applied automatically: operators run it once against a fresh
+// database (or fold it into their own migration tooling) before pointing a
+// Writer at it.
+const Schema = `
+CREATE TABLE IF NOT EXISTS table_data (
+	block_num    BIGINT      NOT NULL,
+	block_time   TIMESTAMPTZ NOT NULL,
+	code         TEXT        NOT NULL,
+	scope        TEXT        NOT NULL,
+	table_name   TEXT        NOT NULL,
+	primary_key  TEXT        NOT NULL,
+	payer        TEXT        NOT NULL,
+	prior_payer  TEXT        NOT NULL,
+	deletion     BOOLEAN     NOT NULL,
+	data         BYTEA,
+	cid          TEXT
+);
+SELECT create_hypertable('table_data', 'block_time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS table_data_key_idx ON table_data (code, scope, table_name, primary_key, block_num);
+
+CREATE TABLE IF NOT EXISTS table_scope (
+	block_num    BIGINT      NOT NULL,
+	block_time   TIMESTAMPTZ NOT NULL,
+	code         TEXT        NOT NULL,
+	scope        TEXT        NOT NULL,
+	table_name   TEXT        NOT NULL,
+	payer        TEXT        NOT NULL,
+	prior_payer  TEXT        NOT NULL,
+	deletion     BOOLEAN     NOT NULL
+);
+SELECT create_hypertable('table_scope', 'block_time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS table_scope_key_idx ON table_scope (code, scope, table_name, block_num);
+
+CREATE TABLE IF NOT EXISTS key_account (
+	block_num    BIGINT      NOT NULL,
+	block_time   TIMESTAMPTZ NOT NULL,
+	public_key   TEXT        NOT NULL,
+	account      TEXT        NOT NULL,
+	permission   TEXT        NOT NULL,
+	deletion     BOOLEAN     NOT NULL
+);
+SELECT create_hypertable('key_account', 'block_time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS key_account_key_idx ON key_account (public_key, block_num);
+
+CREATE TABLE IF NOT EXISTS perm_link (
+	block_num          BIGINT      NOT NULL,
+	block_time         TIMESTAMPTZ NOT NULL,
+	account            TEXT        NOT NULL,
+	code               TEXT        NOT NULL,
+	action_name        TEXT        NOT NULL,
+	requirement        TEXT        NOT NULL,
+	deletion           BOOLEAN     NOT NULL
+);
+SELECT create_hypertable('perm_link', 'block_time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS perm_link_key_idx ON perm_link (account, code, action_name, block_num);
+
+CREATE TABLE IF NOT EXISTS account_operation_count (
+	account       TEXT    NOT NULL PRIMARY KEY,
+	operations    BIGINT  NOT NULL DEFAULT 0,
+	last_block_num BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE IF NOT EXISTS account_permission_link (
+	block_num         BIGINT      NOT NULL,
+	block_time        TIMESTAMPTZ NOT NULL,
+	account           TEXT        NOT NULL,
+	permission        TEXT        NOT NULL,
+	linked_account    TEXT        NOT NULL,
+	linked_permission TEXT        NOT NULL,
+	weight            INT         NOT NULL,
+	deletion          BOOLEAN     NOT NULL
+);
+SELECT create_hypertable('account_permission_link', 'block_time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS account_permission_link_key_idx ON account_permission_link (account, permission, block_num);
+
+CREATE TABLE IF NOT EXISTS permission_meta (
+	block_num    BIGINT      NOT NULL,
+	block_time   TIMESTAMPTZ NOT NULL,
+	account      TEXT        NOT NULL,
+	permission   TEXT        NOT NULL,
+	parent       TEXT        NOT NULL,
+	threshold    BIGINT      NOT NULL,
+	deletion     BOOLEAN     NOT NULL
+);
+SELECT create_hypertable('permission_meta', 'block_time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS permission_meta_key_idx ON permission_meta (account, permission, block_num);
+
+CREATE TABLE IF NOT EXISTS authority (
+	block_num    BIGINT      NOT NULL,
+	block_time   TIMESTAMPTZ NOT NULL,
+	account      TEXT        NOT NULL,
+	permission   TEXT        NOT NULL,
+	kind         SMALLINT    NOT NULL,
+	subject      TEXT        NOT NULL,
+	weight       INT         NOT NULL,
+	deletion     BOOLEAN     NOT NULL
+);
+SELECT create_hypertable('authority', 'block_time', if_not_exists => TRUE);
+CREATE INDEX IF NOT EXISTS authority_key_idx ON authority (account, permission, kind, subject, block_num);
+`
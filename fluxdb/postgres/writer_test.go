@@ -0,0 +1,277 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"regexp"
+	"testing"
+	"time"
+
+	sqlmock "github.com/DATA-DOG/go-sqlmock"
+	"github.com/dfuse-io/dfuse-eosio/fluxdb"
+	"github.com/eoscanada/eos-go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func N(s string) eos.Name {
+	return eos.Name(eos.MustStringToName(s))
+}
+
+func TestBumpOperationCounter(t *testing.T) {
+	counters := map[eos.Name]int64{}
+
+	bumpOperationCounter(counters, N("eosio"))
+	bumpOperationCounter(counters, N("eosio"))
+	bumpOperationCounter(counters, N("eosio.token"))
+
+	assert.Equal(t, int64(2), counters[N("eosio")])
+	assert.Equal(t, int64(1), counters[N("eosio.token")])
+}
+
+func newMockWriter(t *testing.T) (*Writer, sqlmock.Sqlmock, func()) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	return NewWriter(db), mock, func() { db.Close() }
+}
+
+// TestWriter_Write_InsertsRowsAndBumpsCounters exercises the happy path of
+// Write end to end against a mocked connection: every row produces its
+// insert, and each distinct account touched gets exactly one counter
+// upsert, all inside one transaction. Nothing here was covered before -
+// writer_test.go only exercised the pure bumpOperationCounter helper.
+func TestWriter_Write_InsertsRowsAndBumpsCounters(t *testing.T) {
+	w, mock, closeDB := newMockWriter(t)
+	defer closeDB()
+
+	req := &fluxdb.WriteRequest{
+		TableDatas: []*fluxdb.TableDataRow{
+			{N("eosio.token"), N("alice"), N("accounts"), N("EOS"), N("alice"), false, []byte("d1")},
+		},
+		TableScopes: []*fluxdb.TableScopeRow{
+			{N("eosio.token"), N("alice"), N("accounts"), false, N("alice")},
+		},
+		KeyAccounts: []*fluxdb.KeyAccountRow{
+			{"k1", N("alice"), N("active"), false},
+		},
+	}
+
+	mock.ExpectBegin()
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT payer FROM table_data`)).
+		WillReturnRows(sqlmock.NewRows([]string{"payer"}))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO table_data`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT payer FROM table_scope`)).
+		WillReturnRows(sqlmock.NewRows([]string{"payer"}))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO table_scope`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO key_account`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	// eosio.token (table_data + table_scope) and alice (key_account) each
+	// get their own upsert.
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO account_operation_count`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO account_operation_count`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	mock.ExpectCommit()
+
+	err := w.Write(context.Background(), 100, time.Now(), req)
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// TestWriter_Write_InsertsPermissionRows covers the three authority-graph
+// row kinds chunk0-3 added to WriteRequest: Write must persist them, not
+// just TableDatas/TableScopes/KeyAccounts.
+func TestWriter_Write_InsertsPermissionRows(t *testing.T) {
+	w, mock, closeDB := newMockWriter(t)
+	defer closeDB()
+
+	req := &fluxdb.WriteRequest{
+		AccountPermissionLinks: []*fluxdb.AccountPermissionLinkRow{
+			{N("eosio"), N("active"), N("bob"), N("active"), 1, false},
+		},
+		PermissionMetas: []*fluxdb.PermissionMetaRow{
+			{N("eosio"), N("active"), N("owner"), 1, false},
+		},
+		Authorities: []*fluxdb.AuthorityRow{
+			{N("eosio"), N("active"), fluxdb.AuthoritySubjectKey, "k1", 1, false},
+		},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO account_permission_link`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO permission_meta`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO authority`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	// All three rows are about "eosio", so a single counter upsert covers them.
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO account_operation_count`)).
+		WithArgs("eosio", int64(3), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := w.Write(context.Background(), 100, time.Now(), req)
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWriter_Write_RollsBackOnInsertError(t *testing.T) {
+	w, mock, closeDB := newMockWriter(t)
+	defer closeDB()
+
+	req := &fluxdb.WriteRequest{
+		TableDatas: []*fluxdb.TableDataRow{
+			{N("eosio.token"), N("alice"), N("accounts"), N("EOS"), N("alice"), false, []byte("d1")},
+		},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT payer FROM table_data`)).
+		WillReturnRows(sqlmock.NewRows([]string{"payer"}))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO table_data`)).
+		WillReturnError(sql.ErrConnDone)
+	mock.ExpectRollback()
+
+	err := w.Write(context.Background(), 100, time.Now(), req)
+	require.Error(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWriter_PriorPayer_ReturnsPayerOfMostRecentRow(t *testing.T) {
+	w, mock, closeDB := newMockWriter(t)
+	defer closeDB()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT payer FROM table_data`)).
+		WillReturnRows(sqlmock.NewRows([]string{"payer"}).AddRow("bob"))
+
+	tx, err := w.db.Begin()
+	require.NoError(t, err)
+
+	payer, err := w.priorPayer(context.Background(), tx, "table_data", 100,
+		"code = $1 AND scope = $2 AND table_name = $3 AND primary_key = $4",
+		"eosio.token", "alice", "accounts", "EOS",
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "bob", payer)
+	require.NoError(t, tx.Rollback())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWriter_PriorPayer_ReturnsEmptyWhenRowDidNotExistYet(t *testing.T) {
+	w, mock, closeDB := newMockWriter(t)
+	defer closeDB()
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT payer FROM table_data`)).
+		WillReturnRows(sqlmock.NewRows([]string{"payer"}))
+
+	tx, err := w.db.Begin()
+	require.NoError(t, err)
+
+	payer, err := w.priorPayer(context.Background(), tx, "table_data", 100,
+		"code = $1 AND scope = $2 AND table_name = $3 AND primary_key = $4",
+		"eosio.token", "alice", "accounts", "EOS",
+	)
+	require.NoError(t, err)
+	assert.Equal(t, "", payer)
+	require.NoError(t, tx.Rollback())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+func TestWriter_BumpAccountCounters_UpsertsOnConflict(t *testing.T) {
+	w, mock, closeDB := newMockWriter(t)
+	defer closeDB()
+
+	mock.ExpectBegin()
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO account_operation_count`)).
+		WithArgs("eosio.token", int64(3), sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+
+	tx, err := w.db.Begin()
+	require.NoError(t, err)
+
+	err = w.bumpAccountCounters(context.Background(), tx, 100, map[eos.Name]int64{N("eosio.token"): 3})
+	require.NoError(t, err)
+	require.NoError(t, tx.Commit())
+	require.NoError(t, mock.ExpectationsWereMet())
+}
+
+// fakeBlobStore is an in-memory BlobStore, standing in for the real thing
+// the way fluxdb's own cas_test.go does.
+type fakeBlobStore struct {
+	data map[fluxdb.RowCID][]byte
+}
+
+func newFakeBlobStore() *fakeBlobStore {
+	return &fakeBlobStore{data: map[fluxdb.RowCID][]byte{}}
+}
+
+func (s *fakeBlobStore) Put(cid fluxdb.RowCID, data []byte) error {
+	s.data[cid] = data
+	return nil
+}
+
+func (s *fakeBlobStore) Get(cid fluxdb.RowCID) ([]byte, bool, error) {
+	data, found := s.data[cid]
+	return data, found, nil
+}
+
+// TestWriter_Write_WithBlobStore_InsertsCIDInsteadOfData exercises the path
+// added in NewWriterWithBlobStore: the row's payload goes to the blob
+// store and only its CID is inserted into table_data.
+func TestWriter_Write_WithBlobStore_InsertsCIDInsteadOfData(t *testing.T) {
+	db, mock, err := sqlmock.New()
+	require.NoError(t, err)
+	defer db.Close()
+
+	blobs := newFakeBlobStore()
+	w := NewWriterWithBlobStore(db, blobs)
+
+	req := &fluxdb.WriteRequest{
+		TableDatas: []*fluxdb.TableDataRow{
+			{N("eosio.token"), N("alice"), N("accounts"), N("eos"), N("alice"), false, []byte("d1")},
+		},
+	}
+
+	mock.ExpectBegin()
+	mock.ExpectQuery(regexp.QuoteMeta(`SELECT payer FROM table_data`)).
+		WillReturnRows(sqlmock.NewRows([]string{"payer"}))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO table_data`)).
+		WithArgs(
+			sqlmock.AnyArg(), sqlmock.AnyArg(),
+			"eosio.token", "alice", "accounts", "eos", "alice", "", false,
+			[]byte(nil), string(fluxdb.ComputeRowCID([]byte("d1"))),
+		).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec(regexp.QuoteMeta(`INSERT INTO account_operation_count`)).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err = w.Write(context.Background(), 100, time.Now(), req)
+	require.NoError(t, err)
+	require.NoError(t, mock.ExpectationsWereMet())
+
+	assert.Equal(t, []byte("d1"), blobs.data[fluxdb.ComputeRowCID([]byte("d1"))])
+}
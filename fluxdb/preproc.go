@@ -0,0 +1,248 @@
+// Copyright 2020 dfuse Platform Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package fluxdb
+
+import (
+	"github.com/dfuse-io/bstream"
+	pbcodec "github.com/dfuse-io/dfuse-eosio/pb/dfuse/eosio/codec/v1"
+	"github.com/eoscanada/eos-go"
+)
+
+// N converts an EOS name string to its packed eos.Name representation, the
+// form every row in this package keys and compares by.
+func N(in string) eos.Name {
+	return eos.Name(eos.MustStringToName(in))
+}
+
+// WriteRequest is the per-block diff PreprocessBlock produces: every table
+// row, table/scope pair and key/account link touched by the block,
+// collapsed down to their net effect.
+type WriteRequest struct {
+	TableDatas  []*TableDataRow
+	TableScopes []*TableScopeRow
+	KeyAccounts []*KeyAccountRow
+
+	AccountPermissionLinks []*AccountPermissionLinkRow
+	PermissionMetas        []*PermissionMetaRow
+	Authorities            []*AuthorityRow
+}
+
+// TableDataRow is the net effect, over one block, of all DBOps touching a
+// single (code, scope, table, primary key). A block that both creates and
+// destroys a row (or otherwise leaves it exactly as it found it) produces
+// no row at all.
+type TableDataRow struct {
+	Code     eos.Name
+	Scope    eos.Name
+	Table    eos.Name
+	Key      eos.Name
+	Payer    eos.Name
+	Deletion bool
+	Data     []byte
+}
+
+// TableScopeRow is the net effect, over one block, of all TableOps
+// touching a single (code, scope, table): whether the table still exists
+// at the end of the block, and who last paid for it.
+type TableScopeRow struct {
+	Account  eos.Name
+	Scope    eos.Name
+	Table    eos.Name
+	Deletion bool
+	Payer    eos.Name
+}
+
+// KeyAccountRow links a public key to the account@permission it signs for,
+// one row per key. It is keyed on (PublicKey, Account, Permission); the
+// last PermOp to touch that triple within the block wins.
+type KeyAccountRow struct {
+	PublicKey  string
+	Account    eos.Name
+	Permission eos.Name
+	Deletion   bool
+}
+
+// PreprocessBlock is run once per block, ahead of any fluxdb writer, and
+// turns its DBOps/TableOps/PermOps into the compact WriteRequest every
+// fluxdb backend persists.
+func PreprocessBlock(blk *bstream.Block) (interface{}, error) {
+	return PreprocessBlockWithFilter(blk, nil)
+}
+
+// PreprocessBlockWithFilter is PreprocessBlock, but drops any row that
+// doesn't match filter before it is added to the WriteRequest - so a
+// filtered shard never persists the rows it isn't keeping.
+// filter may be nil, in which case every op is kept.
+func PreprocessBlockWithFilter(blk *bstream.Block, filter *PreprocessFilter) (interface{}, error) {
+	block := blk.ToNative().(*pbcodec.Block)
+
+	var tableOps []*pbcodec.TableOp
+	var dbOps []*pbcodec.DBOp
+	var permOps []*pbcodec.PermOp
+	for _, trx := range block.TransactionTraces {
+		tableOps = append(tableOps, trx.TableOps...)
+		dbOps = append(dbOps, trx.DbOps...)
+		permOps = append(permOps, trx.PermOps...)
+	}
+
+	links, metas, authorities := ExtractPermissionRows(permOps, filter)
+
+	return &WriteRequest{
+		TableScopes: extractTableScopeRows(tableOps, filter),
+		TableDatas:  extractTableDataRows(dbOps, filter),
+		KeyAccounts: extractKeyAccountRows(permOps, filter),
+
+		AccountPermissionLinks: links,
+		PermissionMetas:        metas,
+		Authorities:            authorities,
+	}, nil
+}
+
+type tableScopeKey struct{ account, scope, table eos.Name }
+
+func extractTableScopeRows(ops []*pbcodec.TableOp, filter *PreprocessFilter) []*TableScopeRow {
+	var order []tableScopeKey
+	last := map[tableScopeKey]*pbcodec.TableOp{}
+
+	for _, op := range ops {
+		key := tableScopeKey{N(op.Code), N(op.Scope), N(op.TableName)}
+		if _, seen := last[key]; !seen {
+			order = append(order, key)
+		}
+		last[key] = op
+	}
+
+	var rows []*TableScopeRow
+	for _, key := range order {
+		op := last[key]
+		row := &TableScopeRow{
+			Account:  key.account,
+			Scope:    key.scope,
+			Table:    key.table,
+			Deletion: op.Operation == pbcodec.TableOp_OPERATION_REMOVE,
+			Payer:    N(op.Payer),
+		}
+
+		if filter != nil && !filter.matchesTableScope(row) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+type dbRowKey struct{ code, scope, table, key eos.Name }
+
+type dbRowAccum struct {
+	firstOldPayer string
+	firstOldData  string
+	lastOp        *pbcodec.DBOp
+}
+
+func extractTableDataRows(ops []*pbcodec.DBOp, filter *PreprocessFilter) []*TableDataRow {
+	var order []dbRowKey
+	accum := map[dbRowKey]*dbRowAccum{}
+
+	for _, op := range ops {
+		key := dbRowKey{N(op.Code), N(op.Scope), N(op.TableName), N(op.PrimaryKey)}
+		acc, seen := accum[key]
+		if !seen {
+			acc = &dbRowAccum{firstOldPayer: op.OldPayer, firstOldData: string(op.OldData)}
+			accum[key] = acc
+			order = append(order, key)
+		}
+		acc.lastOp = op
+	}
+
+	var rows []*TableDataRow
+	for _, key := range order {
+		acc := accum[key]
+		op := acc.lastOp
+
+		if acc.firstOldPayer == op.NewPayer && acc.firstOldData == string(op.NewData) {
+			// Net no-op over the block: what it looked like before equals
+			// what it looks like after, so there is nothing to write.
+			continue
+		}
+
+		deletion := op.Operation == pbcodec.DBOp_OPERATION_REMOVE
+		data := op.NewData
+		if deletion {
+			data = nil
+		}
+
+		row := &TableDataRow{
+			Code: key.code, Scope: key.scope, Table: key.table, Key: key.key,
+			Payer:    N(op.NewPayer),
+			Deletion: deletion,
+			Data:     data,
+		}
+
+		if filter != nil && !filter.matchesTableData(row) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+type keyAccountKey struct {
+	publicKey  string
+	account    eos.Name
+	permission eos.Name
+}
+
+func extractKeyAccountRows(ops []*pbcodec.PermOp, filter *PreprocessFilter) []*KeyAccountRow {
+	var order []keyAccountKey
+	deletion := map[keyAccountKey]bool{}
+
+	apply := func(perm *pbcodec.PermissionObject, isDeletion bool) {
+		if perm == nil || perm.Authority == nil {
+			return
+		}
+		for _, kw := range perm.Authority.Keys {
+			key := keyAccountKey{kw.PublicKey, N(perm.Owner), N(perm.Name)}
+			if _, seen := deletion[key]; !seen {
+				order = append(order, key)
+			}
+			deletion[key] = isDeletion
+		}
+	}
+
+	for _, op := range ops {
+		switch op.Operation {
+		case pbcodec.PermOp_OPERATION_INSERT, pbcodec.PermOp_OPERATION_UPDATE:
+			apply(op.NewPerm, false)
+		case pbcodec.PermOp_OPERATION_REMOVE:
+			apply(op.OldPerm, true)
+		}
+	}
+
+	var rows []*KeyAccountRow
+	for _, key := range order {
+		row := &KeyAccountRow{
+			PublicKey:  key.publicKey,
+			Account:    key.account,
+			Permission: key.permission,
+			Deletion:   deletion[key],
+		}
+
+		if filter != nil && !filter.matchesKeyAccount(row) {
+			continue
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}